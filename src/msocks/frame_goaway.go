@@ -0,0 +1,35 @@
+package msocks
+
+// MSG_GOAWAY tells the peer no new streams will be accepted on this
+// session. It carries the reason for the shutdown and the last
+// stream id the sender is still willing to service, so the peer knows
+// which in-flight streams are still safe to finish. Built with
+// NewFrameOneInt(MSG_GOAWAY, lastStreamId, reason) like MSG_FAILED.
+const MSG_GOAWAY = 0x0a
+
+const (
+	GoAwayNormal = iota
+	GoAwayProtocolError
+	GoAwayInternalError
+)
+
+// ERR_GOAWAY is the MSG_FAILED errno used to reject a SYN that
+// arrives after we've already sent our own GOAWAY: we're only
+// draining streams that existed before that point, not opening new
+// ones in either direction.
+const ERR_GOAWAY = 0x03
+
+// FrameGoAway is the parsed form of an incoming MSG_GOAWAY.
+type FrameGoAway struct {
+	LastStreamId uint16
+	Reason       int32
+}
+
+// GoAway isn't scoped to a single stream, so GetStreamid is 0.
+func (f *FrameGoAway) GetStreamid() uint16 {
+	return 0
+}
+
+func (f *FrameGoAway) Debug() {
+	logger.Debugf("frame goaway: last_stream(%d), reason(%d).", f.LastStreamId, f.Reason)
+}
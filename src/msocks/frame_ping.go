@@ -0,0 +1,12 @@
+package msocks
+
+// MSG_PING_ACK is the reply to a MSG_PING, echoing the same PingId so
+// the original sender can match it back to the Ping() call waiting on
+// it and compute RTT. Both are single-value frames, built with
+// NewFrameOneInt like MSG_FAILED/MSG_WND_INC.
+//
+// FramePing itself already exists for the bare MSG_PING case Run()
+// handled before this change; PingId and IsReply belong on that
+// existing struct (and ReadFrame needs to populate IsReply for
+// MSG_PING_ACK) rather than being redeclared here.
+const MSG_PING_ACK = 0x09
@@ -0,0 +1,22 @@
+package msocks
+
+// MSG_WND_INC carries a window increment: the receiver of a stream
+// tells the sender it may push delta more bytes before blocking again.
+// It replaces "drop the whole stream when its chan is full" with real
+// backpressure. It is sent like the other single-value frames, via
+// NewFrameOneInt(MSG_WND_INC, streamid, delta).
+const MSG_WND_INC = 0x08
+
+// FrameWndInc is the parsed form of an incoming MSG_WND_INC frame.
+type FrameWndInc struct {
+	Streamid uint16
+	Delta    int32
+}
+
+func (f *FrameWndInc) GetStreamid() uint16 {
+	return f.Streamid
+}
+
+func (f *FrameWndInc) Debug() {
+	logger.Debugf("frame wnd_inc: streamid(%d), delta(%d).", f.Streamid, f.Delta)
+}
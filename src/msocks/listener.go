@@ -0,0 +1,27 @@
+package msocks
+
+import "net"
+
+// Listener adapts a Session to net.Listener so it can be handed
+// straight to anything written against the stdlib interface, e.g.
+// http.Server.Serve or grpc.Server.Serve, turning msocks from an
+// internal proxy helper into a general-purpose stream multiplexer.
+type Listener struct {
+	sess *Session
+}
+
+func NewListener(sess *Session) *Listener {
+	return &Listener{sess: sess}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	return l.sess.Accept()
+}
+
+func (l *Listener) Close() error {
+	return l.sess.Close()
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.sess.LocalAddr()
+}
@@ -0,0 +1,114 @@
+package msocks
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// Resolver is how a Session turns a FrameDns hostname into addresses.
+// It exists so callers can swap in a different lookup strategy (a
+// test stub, a resolver that hits a split-horizon DNS server, ...)
+// instead of being stuck with net.LookupIP.
+type Resolver interface {
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// netResolver is the default Resolver: it wraps net.Resolver and
+// bounds every lookup by LOOKUP_TIMEOUT, which used to be declared
+// but never actually applied anywhere.
+type netResolver struct {
+	r *net.Resolver
+}
+
+func NewNetResolver() Resolver {
+	return &netResolver{r: net.DefaultResolver}
+}
+
+func (nr *netResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(ctx, LOOKUP_TIMEOUT)
+	defer cancel()
+
+	addrs, err := nr.r.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips, nil
+}
+
+type dnsCacheEntry struct {
+	host    string
+	ips     []net.IP
+	expires time.Time
+}
+
+// cachingResolver adds a bounded, TTL-based LRU in front of another
+// Resolver so repeated lookups of the same host (common for a proxy
+// that keeps reconnecting to the same few sites) don't all pay for a
+// fresh round trip.
+type cachingResolver struct {
+	next Resolver
+	ttl  time.Duration
+	cap  int
+
+	mu    sync.Mutex
+	order *list.List
+	items map[string]*list.Element
+}
+
+// NewCachingResolver wraps next with an LRU cache of at most capacity
+// hostnames, each valid for ttl.
+func NewCachingResolver(next Resolver, ttl time.Duration, capacity int) Resolver {
+	return &cachingResolver{
+		next:  next,
+		ttl:   ttl,
+		cap:   capacity,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (c *cachingResolver) LookupIP(ctx context.Context, host string) (ips []net.IP, err error) {
+	c.mu.Lock()
+	if el, ok := c.items[host]; ok {
+		ent := el.Value.(*dnsCacheEntry)
+		if time.Now().Before(ent.expires) {
+			c.order.MoveToFront(el)
+			ips = ent.ips
+			c.mu.Unlock()
+			return ips, nil
+		}
+		c.order.Remove(el)
+		delete(c.items, host)
+	}
+	c.mu.Unlock()
+
+	ips, err = c.next.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	el := c.order.PushFront(&dnsCacheEntry{
+		host:    host,
+		ips:     ips,
+		expires: time.Now().Add(c.ttl),
+	})
+	c.items[host] = el
+	for c.order.Len() > c.cap {
+		back := c.order.Back()
+		if back == nil {
+			break
+		}
+		c.order.Remove(back)
+		delete(c.items, back.Value.(*dnsCacheEntry).host)
+	}
+	c.mu.Unlock()
+	return ips, nil
+}
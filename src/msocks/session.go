@@ -1,6 +1,7 @@
 package msocks
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -19,12 +20,23 @@ const (
 	PINGTIME       = 30 * time.Second
 	DIAL_TIMEOUT   = 30 * time.Second
 	LOOKUP_TIMEOUT = 60 * time.Second
+
+	// GOAWAY_DRAIN_TIMEOUT bounds how long GoAway waits for
+	// in-flight streams to finish on their own before giving up
+	// and returning anyway.
+	GOAWAY_DRAIN_TIMEOUT = 10 * time.Second
+
+	// ACCEPT_BACKLOG is how many inbound streams Accept will queue
+	// before on_syn starts rejecting new SYNs with MSG_FAILED.
+	ACCEPT_BACKLOG = 256
 )
 
-// use 1024 as default channel length, 1024 * 1024 = 1M
-// that is the buffer before read, and it's the maxmium length of write window.
-// default value of write window is 256K.
-// that will be sent in 0.1s, so maxmium speed will be 2.56M/s = 20Mbps.
+// CHANLEN is just the depth of the per-stream frame channel, used as a
+// cushion between Run's reader loop and Stream.loop so a slow consumer
+// doesn't stall frame dispatch for other streams. It is no longer the
+// thing protecting against a slow reader: real backpressure comes from
+// the per-stream sliding window (WIN_SIZE), advertised by each side and
+// replenished via MSG_WND_INC as the peer reads (see stream.go).
 
 var logger logging.Logger
 
@@ -36,60 +48,194 @@ func init() {
 	}
 }
 
-// TODO: ping/echo
+// Config bundles the knobs that used to be hard-coded constants
+// (PINGTIME and friends) so callers can tune a Session to their
+// network instead of recompiling. A nil Config passed to NewSession is
+// replaced with DefaultConfig().
+type Config struct {
+	// KeepAliveInterval is how long the ping loop sleeps between
+	// pings, whether or not the session carries other traffic.
+	KeepAliveInterval time.Duration
+	// ConnectionWriteTimeout bounds how long a ping may go
+	// unacked before the session is considered dead.
+	ConnectionWriteTimeout time.Duration
+	// EnableKeepAlive turns the background ping loop on or off.
+	EnableKeepAlive bool
+
+	// Resolver answers on_dns lookups. Defaults to NewNetResolver().
+	Resolver Resolver
+	// DNSCacheSize, when > 0, wraps Resolver in a bounded LRU cache
+	// of this many hostnames, each cached for DNSCacheTTL.
+	DNSCacheSize int
+	DNSCacheTTL  time.Duration
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		KeepAliveInterval:      PINGTIME,
+		ConnectionWriteTimeout: 6 * PINGTIME,
+		EnableKeepAlive:        true,
+		Resolver:               NewNetResolver(),
+	}
+}
+
 type Session struct {
 	flock sync.Mutex
 	conn  net.Conn
 
+	closeOnce sync.Once
+
+	cfg *Config
+
 	// lock ports before any ports op and id op
-	plock   sync.Mutex
-	next_id uint16
-	ports   map[uint16]chan Frame
+	plock     sync.Mutex
+	next_id   uint16
+	ports     map[uint16]chan Frame
+	idleclose *time.Timer
+
+	// localGoAway is set once we've sent our own GOAWAY, remoteGoAway
+	// once the peer has sent theirs; either stops new streams from
+	// being allocated while letting existing ones drain.
+	localGoAway  bool
+	remoteGoAway bool
 
 	on_conn func(string, string, uint16) (chan Frame, error)
 
-	ch_ping chan int
+	// pingLock guards pingId/pings, which map an outstanding ping
+	// to the channel its ack reply will close.
+	pingLock sync.Mutex
+	pingId   uint32
+	pings    map[uint32]chan struct{}
+
+	resolver Resolver
+
+	// dnsLock guards dnsInflight/dnsWaiters, which coalesce
+	// concurrent FrameDns requests for the same hostname onto a
+	// single lookup and let Close cancel outstanding ones.
+	dnsLock     sync.Mutex
+	dnsInflight map[string]context.CancelFunc
+	dnsWaiters  map[string][]uint16
+
+	// acceptCh feeds Accept with streams created by incoming SYNs
+	// when on_conn hasn't been set, i.e. when this Session is being
+	// used as a plain net.Listener rather than a proxy backend.
+	// acceptCh is never closed (on_syn's goroutine can still be
+	// sending on it when Close runs); done is what signals shutdown
+	// to Accept and acceptStream instead.
+	acceptCh chan *Stream
+	done     chan struct{}
+
+	writer *writer
 }
 
-func NewSession(conn net.Conn) (s *Session) {
+func NewSession(conn net.Conn, cfg *Config) (s *Session) {
+	if cfg == nil {
+		cfg = DefaultConfig()
+	}
+	if cfg.KeepAliveInterval <= 0 {
+		cfg.KeepAliveInterval = DefaultConfig().KeepAliveInterval
+	}
+	if cfg.ConnectionWriteTimeout <= 0 {
+		cfg.ConnectionWriteTimeout = DefaultConfig().ConnectionWriteTimeout
+	}
+	resolver := cfg.Resolver
+	if resolver == nil {
+		resolver = NewNetResolver()
+	}
+	if cfg.DNSCacheSize > 0 {
+		resolver = NewCachingResolver(resolver, cfg.DNSCacheTTL, cfg.DNSCacheSize)
+	}
+
 	s = &Session{
-		conn:    conn,
-		ports:   make(map[uint16]chan Frame, 0),
-		idle:    time.NewTicker(PINGTIME),
-		ch_ping: make(chan int, 3),
+		conn:        conn,
+		cfg:         cfg,
+		ports:       make(map[uint16]chan Frame, 0),
+		pings:       make(map[uint32]chan struct{}),
+		resolver:    resolver,
+		dnsInflight: make(map[string]context.CancelFunc),
+		dnsWaiters:  make(map[string][]uint16),
+		acceptCh:    make(chan *Stream, ACCEPT_BACKLOG),
+		done:        make(chan struct{}),
 	}
+	s.writer = newWriter(s)
 	logger.Noticef("session %p created.", s)
-	go s.keep_eye_open()
-	s.ch_ping <- 1
+	if cfg.EnableKeepAlive {
+		go s.keep_eye_open()
+	}
 	return
 }
 
+// keep_eye_open sends a ping every KeepAliveInterval and tears the
+// session down with errPingTimeout if the reply doesn't make it back
+// within ConnectionWriteTimeout, replacing the old fixed 30s/6x scheme.
 func (s *Session) keep_eye_open() {
 	for {
-		timeout := time.After(6 * PINGTIME)
-		select {
-		case <-timeout:
+		time.Sleep(s.cfg.KeepAliveInterval)
+		if _, err := s.Ping(); err != nil {
+			logger.Err(err)
 			s.Close()
 			return
-		case <-s.ch_ping:
-		PING:
-			for {
-				select {
-				case <-s.ch_ping:
-				default:
-					break PING
-				}
-			}
-			time.Sleep(PINGTIME)
-			b := NewFrameNoParam(MSG_PING, 0)
-			_, err = s.Write(b)
-			if err != nil {
-				logger.Err(err)
-			}
 		}
 	}
 }
 
+var errPingTimeout = errors.New("msocks: keepalive ping timed out")
+
+// Ping sends a MSG_PING carrying a fresh id and blocks until the
+// matching MSG_PING reply arrives or ConnectionWriteTimeout elapses,
+// returning the measured round trip time.
+func (s *Session) Ping() (rtt time.Duration, err error) {
+	s.pingLock.Lock()
+	id := s.pingId
+	s.pingId++
+	ch := make(chan struct{})
+	s.pings[id] = ch
+	s.pingLock.Unlock()
+
+	start := time.Now()
+	_, err = s.enqueueFrame(NewFrameOneInt(MSG_PING, 0, int(id)), 0, PriorityControl)
+	if err != nil {
+		s.pingLock.Lock()
+		delete(s.pings, id)
+		s.pingLock.Unlock()
+		return
+	}
+
+	select {
+	case <-ch:
+		return time.Since(start), nil
+	case <-time.After(s.cfg.ConnectionWriteTimeout):
+		s.pingLock.Lock()
+		delete(s.pings, id)
+		s.pingLock.Unlock()
+		return 0, errPingTimeout
+	}
+}
+
+// on_ping handles an incoming MSG_PING: it's the peer's probe, so we
+// echo the same id back as a MSG_PING_ACK.
+func (s *Session) on_ping(ft *FramePing) {
+	b := NewFrameOneInt(MSG_PING_ACK, 0, int(ft.PingId))
+	_, err := s.enqueueFrame(b, 0, PriorityControl)
+	if err != nil {
+		logger.Err(err)
+	}
+}
+
+// on_ping_ack handles an incoming MSG_PING_ACK: if it matches one of
+// our outstanding pings, it wakes up the Ping() call waiting on it.
+func (s *Session) on_ping_ack(ft *FramePing) {
+	s.pingLock.Lock()
+	ch, ok := s.pings[ft.PingId]
+	if ok {
+		delete(s.pings, ft.PingId)
+	}
+	s.pingLock.Unlock()
+	if ok {
+		close(ch)
+	}
+}
+
 func (s *Session) LocalAddr() net.Addr {
 	return s.conn.LocalAddr()
 }
@@ -117,19 +263,116 @@ func (s *Session) Write(b []byte) (n int, err error) {
 	return
 }
 
+var errWriteTimeout = errors.New("msocks: timed out waiting for write to be scheduled")
+
+// enqueueFrame queues b through the writer subsystem instead of
+// writing it to the conn directly, so control frames (priority
+// PriorityControl) can't be stuck behind a stream's DATA frames
+// (priority PriorityData). streamid only matters for PriorityData,
+// where it's the fairness key. Queuing blocks while the writer's queue
+// is full; once queued, it waits at most ConnectionWriteTimeout for
+// the write's result.
+func (s *Session) enqueueFrame(b []byte, streamid uint16, priority int) (n int, err error) {
+	done := s.writer.enqueue(streamid, b, priority)
+	select {
+	case err = <-done:
+		if err == nil {
+			n = len(b)
+		}
+		return
+	case <-time.After(s.cfg.ConnectionWriteTimeout):
+		return 0, errWriteTimeout
+	}
+}
+
+// Close is the hard, immediate teardown: every stream is aborted and
+// the underlying conn is closed right away. For a shutdown that lets
+// in-flight streams finish, use GoAway instead. It's safe to call more
+// than once; only the first call does anything.
 func (s *Session) Close() (err error) {
-	logger.Warningf("close all(len:%d) for session: %p.", len(s.ports), s)
-	defer s.conn.Close()
-	for _, v := range s.ports {
-		v <- nil
+	s.closeOnce.Do(func() {
+		s.plock.Lock()
+		ports := make(map[uint16]chan Frame, len(s.ports))
+		for k, v := range s.ports {
+			ports[k] = v
+		}
+		s.plock.Unlock()
+
+		logger.Warningf("close all(len:%d) for session: %p.", len(ports), s)
+		defer s.conn.Close()
+
+		s.dnsLock.Lock()
+		for _, cancel := range s.dnsInflight {
+			cancel()
+		}
+		s.dnsLock.Unlock()
+
+		for _, v := range ports {
+			v <- nil
+		}
+		close(s.done)
+		s.writer.Close()
+	})
+	return nil
+}
+
+// GoAway announces that this session will accept no more new streams
+// (PutIntoNextId starts failing with errGoAway), then waits up to
+// GOAWAY_DRAIN_TIMEOUT for streams already open to finish on their
+// own before returning. It does not forcibly close them; callers that
+// want a hard deadline should follow up with Close.
+func (s *Session) GoAway(reason int) (err error) {
+	s.plock.Lock()
+	if s.localGoAway {
+		s.plock.Unlock()
+		return nil
 	}
-	return
+	s.localGoAway = true
+	lastStreamId := s.next_id
+	s.plock.Unlock()
+
+	logger.Noticef("session %p going away(reason:%d), last stream(%d).",
+		s, reason, lastStreamId)
+	_, err = s.enqueueFrame(NewFrameOneInt(MSG_GOAWAY, lastStreamId, reason), 0, PriorityControl)
+	if err != nil {
+		return
+	}
+
+	deadline := time.After(GOAWAY_DRAIN_TIMEOUT)
+	ticker := time.NewTicker(ACKDELAY)
+	defer ticker.Stop()
+	for s.Number() > 0 {
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			logger.Warningf("session %p goaway drain timed out with %d stream(s) left.",
+				s, s.Number())
+			return nil
+		}
+	}
+	return nil
+}
+
+// on_goaway records that the peer won't accept new streams anymore.
+// Existing streams are left alone to drain.
+func (s *Session) on_goaway(ft *FrameGoAway) {
+	logger.Noticef("session %p received goaway(reason:%d), last stream(%d).",
+		s, ft.Reason, ft.LastStreamId)
+	s.plock.Lock()
+	s.remoteGoAway = true
+	s.plock.Unlock()
 }
 
+var errGoAway = errors.New("msocks: session is going away, no new streams")
+
 func (s *Session) PutIntoNextId(ch chan Frame) (id uint16, err error) {
 	s.plock.Lock()
 	defer s.plock.Unlock()
 
+	if s.localGoAway || s.remoteGoAway {
+		return 0, errGoAway
+	}
+
 	startid := s.next_id
 	_, ok := s.ports[s.next_id]
 	for ok {
@@ -181,21 +424,37 @@ func (s *Session) RemovePorts(streamid uint16) (err error) {
 }
 
 func (s *Session) Number() (n int) {
+	s.plock.Lock()
+	defer s.plock.Unlock()
 	return len(s.ports)
 }
 
 func (s *Session) on_syn(ft *FrameSyn) bool {
+	s.plock.Lock()
+	goingAway := s.localGoAway
+	s.plock.Unlock()
+	if goingAway {
+		logger.Noticef("%p(%d): refusing SYN, session is going away.", s, ft.Streamid)
+		b := NewFrameOneInt(MSG_FAILED, ft.Streamid, ERR_GOAWAY)
+		_, err := s.enqueueFrame(b, ft.Streamid, PriorityControl)
+		return err == nil
+	}
+
 	_, ok := s.ports[ft.Streamid]
 	if ok {
 		logger.Err("frame sync stream id exist.")
 		b := NewFrameOneInt(MSG_FAILED, ft.Streamid, ERR_IDEXIST)
-		_, err := s.Write(b)
+		_, err := s.enqueueFrame(b, ft.Streamid, PriorityControl)
 		if err != nil {
 			return false
 		}
 		return true
 	}
 
+	if s.on_conn == nil {
+		return s.acceptStream(ft)
+	}
+
 	// lock streamid temporary, do I need this?
 	s.PutIntoId(ft.Streamid, nil)
 
@@ -207,7 +466,7 @@ func (s *Session) on_syn(ft *FrameSyn) bool {
 			logger.Err(err)
 
 			b := NewFrameOneInt(MSG_FAILED, ft.Streamid, ERR_CONNFAILED)
-			_, err = s.Write(b)
+			_, err = s.enqueueFrame(b, ft.Streamid, PriorityControl)
 			if err != nil {
 				logger.Err(err)
 				return
@@ -224,7 +483,7 @@ func (s *Session) on_syn(ft *FrameSyn) bool {
 		s.PutIntoId(ft.Streamid, ch)
 
 		b := NewFrameNoParam(MSG_OK, ft.Streamid)
-		_, err = s.Write(b)
+		_, err = s.enqueueFrame(b, ft.Streamid, PriorityControl)
 		if err != nil {
 			logger.Err(err)
 			return
@@ -236,31 +495,130 @@ func (s *Session) on_syn(ft *FrameSyn) bool {
 	return true
 }
 
+// acceptStream turns an inbound SYN into a Stream and hands it to
+// whoever is calling Accept, used when this Session has no on_conn
+// callback, i.e. it's being used as a plain net.Listener rather than
+// a proxy backend dialing out on the caller's behalf.
+func (s *Session) acceptStream(ft *FrameSyn) bool {
+	ch := make(chan Frame, CHANLEN)
+	s.PutIntoId(ft.Streamid, ch)
+	st := NewStream(ft.Streamid, s, ch)
+
+	select {
+	case s.acceptCh <- st:
+	case <-s.done:
+		// Session is closing: don't send on acceptCh past this point,
+		// nothing will ever receive from it again.
+		st.Close()
+		return false
+	default:
+		logger.Errf("%p(%d): accept backlog full, refusing.", s, ft.Streamid)
+		st.Close()
+		b := NewFrameOneInt(MSG_FAILED, ft.Streamid, ERR_CONNFAILED)
+		_, err := s.enqueueFrame(b, ft.Streamid, PriorityControl)
+		return err == nil
+	}
+
+	b := NewFrameNoParam(MSG_OK, ft.Streamid)
+	_, err := s.enqueueFrame(b, ft.Streamid, PriorityControl)
+	if err != nil {
+		logger.Err(err)
+		return false
+	}
+	return true
+}
+
+// Accept waits for the next inbound stream opened by the peer. It is
+// only fed when the Session was created without an on_conn callback.
+func (s *Session) Accept() (net.Conn, error) {
+	select {
+	case st := <-s.acceptCh:
+		return st, nil
+	case <-s.done:
+		return nil, io.EOF
+	}
+}
+
+// Open dials out over the session: it sends a MSG_SYN for address and
+// waits for the peer's MSG_OK/MSG_FAILED reply or ctx to be done.
+func (s *Session) Open(ctx context.Context, network, address string) (net.Conn, error) {
+	ch := make(chan Frame, CHANLEN)
+	streamid, err := s.PutIntoNextId(ch)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.enqueueFrame(NewFrameSyn(streamid, address), streamid, PriorityControl)
+	if err != nil {
+		s.RemovePorts(streamid)
+		return nil, err
+	}
+
+	select {
+	case f := <-ch:
+		switch f.(type) {
+		case *FrameOK:
+			return NewStream(streamid, s, ch), nil
+		case *FrameFAILED:
+			s.RemovePorts(streamid)
+			return nil, fmt.Errorf("msocks: open %s failed.", address)
+		default:
+			s.RemovePorts(streamid)
+			return nil, fmt.Errorf("msocks: unexpected frame %T while opening stream.", f)
+		}
+	case <-ctx.Done():
+		s.RemovePorts(streamid)
+		return nil, ctx.Err()
+	}
+}
+
+// on_dns resolves ft.Hostname through s.resolver. A FrameDns for a
+// hostname that's already being looked up is coalesced onto that
+// pending lookup instead of firing a duplicate; every waiting
+// streamid gets the same result once it completes.
 func (s *Session) on_dns(ft *FrameDns) {
-	// This will toke long time...
+	s.dnsLock.Lock()
+	if _, ok := s.dnsInflight[ft.Hostname]; ok {
+		s.dnsWaiters[ft.Hostname] = append(s.dnsWaiters[ft.Hostname], ft.Streamid)
+		s.dnsLock.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.dnsInflight[ft.Hostname] = cancel
+	s.dnsWaiters[ft.Hostname] = []uint16{ft.Streamid}
+	s.dnsLock.Unlock()
+
 	go func() {
-		ipaddr, err := net.LookupIP(ft.Hostname)
+		ipaddr, err := s.resolver.LookupIP(ctx, ft.Hostname)
 		if err != nil {
 			logger.Err(err)
 			ipaddr = make([]net.IP, 0)
 		}
 
-		b, err := NewFrameAddr(ft.Streamid, ipaddr)
-		if err != nil {
-			logger.Err(err)
-			return
-		}
-		_, err = s.Write(b)
-		if err != nil {
-			logger.Err(err)
+		s.dnsLock.Lock()
+		waiters := s.dnsWaiters[ft.Hostname]
+		delete(s.dnsInflight, ft.Hostname)
+		delete(s.dnsWaiters, ft.Hostname)
+		s.dnsLock.Unlock()
+
+		for _, streamid := range waiters {
+			b, err := NewFrameAddr(streamid, ipaddr)
+			if err != nil {
+				logger.Err(err)
+				continue
+			}
+			if _, err = s.enqueueFrame(b, streamid, PriorityControl); err != nil {
+				logger.Err(err)
+			}
 		}
-		return
 	}()
-	return
 }
 
-// In all of situation, drop frame if chan full.
-// And if frame finally come, drop it too.
+// sendFrameInChan hands f to the stream's frame channel. With window
+// based flow control in place the channel should never actually fill
+// under normal operation; a full channel here means the peer ignored
+// our advertised window, which is a protocol violation, so the stream
+// is torn down rather than silently dropping frames forever.
 func (s *Session) sendFrameInChan(f Frame) bool {
 	streamid := f.GetStreamid()
 	ch, ok := s.ports[streamid]
@@ -272,7 +630,7 @@ func (s *Session) sendFrameInChan(f Frame) bool {
 	case ch <- f:
 		return true
 	default:
-		logger.Errf("%p(%d) chan has fulled.", s, streamid)
+		logger.Errf("%p(%d) chan has fulled, peer violated flow control.", s, streamid)
 		return s.RemovePorts(streamid) == nil
 	}
 }
@@ -291,7 +649,7 @@ func (s *Session) Run() {
 		default:
 			logger.Err("unexpected package")
 			return
-		case *FrameOK, *FrameFAILED, *FrameData, *FrameAck, *FrameFin, *FrameAddr:
+		case *FrameOK, *FrameFAILED, *FrameData, *FrameAck, *FrameFin, *FrameAddr, *FrameWndInc:
 			f.Debug()
 			if !s.sendFrameInChan(f) {
 				return
@@ -304,12 +662,16 @@ func (s *Session) Run() {
 		case *FrameDns:
 			f.Debug()
 			go s.on_dns(ft)
+		case *FrameGoAway:
+			f.Debug()
+			s.on_goaway(ft)
 		case *FramePing:
 			f.Debug()
-			select {
-			case s.ch_ping <- 1:
-			default:
+			if ft.IsReply {
+				s.on_ping_ack(ft)
+			} else {
+				s.on_ping(ft)
 			}
 		}
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,61 @@
+package msocks
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestAcceptBacklogOverflowRejectsSyn makes sure a full accept backlog
+// refuses the SYN with MSG_FAILED instead of blocking acceptStream (and
+// thus Run's read loop) forever.
+func TestAcceptBacklogOverflowRejectsSyn(t *testing.T) {
+	s, _ := newTestSession(t)
+	defer s.Close()
+	s.acceptCh = make(chan *Stream) // zero capacity: always "full" without a receiver
+
+	ok := s.on_syn(&FrameSyn{Streamid: 7, Address: "example.com:80"})
+	if !ok {
+		t.Fatalf("on_syn returning false tears the whole session down; a full backlog should just refuse the stream")
+	}
+	if _, exists := s.ports[7]; exists {
+		t.Fatalf("stream 7 should not remain registered once its accept was refused")
+	}
+}
+
+// TestAcceptDuringCloseDoesNotPanic is a regression test for the race
+// between acceptStream's `s.acceptCh <- st` and Close tearing the
+// session down: it must not panic, however the scheduler interleaves
+// the two goroutines.
+func TestAcceptDuringCloseDoesNotPanic(t *testing.T) {
+	s, _ := newTestSession(t)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		s.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		s.on_syn(&FrameSyn{Streamid: 9, Address: "example.com:80"})
+	}()
+	wg.Wait()
+}
+
+// TestAcceptReturnsAfterClose makes sure a blocked Accept wakes up with
+// io.EOF once the session closes, instead of hanging forever now that
+// acceptCh itself is never closed.
+func TestAcceptReturnsAfterClose(t *testing.T) {
+	s, _ := newTestSession(t)
+
+	done := make(chan struct{})
+	go func() {
+		if _, err := s.Accept(); err == nil {
+			t.Error("expected Accept to report an error once the session closed")
+		}
+		close(done)
+	}()
+
+	s.Close()
+	<-done
+}
@@ -0,0 +1,88 @@
+package msocks
+
+import (
+	"testing"
+	"time"
+)
+
+// TestSessionGoAwayRejectsNewSyns makes sure that once GoAway has run,
+// on_syn refuses any further inbound SYN instead of registering it, the
+// same way PutIntoNextId already refuses outbound Opens.
+func TestSessionGoAwayRejectsNewSyns(t *testing.T) {
+	s, _ := newTestSession(t)
+	defer s.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- s.GoAway(GoAwayNormal) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("goaway: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("GoAway should return immediately once there are no streams left")
+	}
+
+	if _, err := s.PutIntoNextId(make(chan Frame)); err != errGoAway {
+		t.Fatalf("expected errGoAway opening a new stream after GoAway, got %v", err)
+	}
+
+	ok := s.on_syn(&FrameSyn{Streamid: 42, Address: "example.com:80"})
+	if !ok {
+		t.Fatalf("on_syn should still report the session healthy, just refuse the stream")
+	}
+	if _, exists := s.ports[42]; exists {
+		t.Fatalf("stream 42 should have been refused, not registered")
+	}
+}
+
+// TestSessionGoAwayDrainsExistingStreams makes sure GoAway returns as
+// soon as the streams open when it was called finish, rather than
+// always waiting out GOAWAY_DRAIN_TIMEOUT.
+func TestSessionGoAwayDrainsExistingStreams(t *testing.T) {
+	s, _ := newTestSession(t)
+	defer s.Close()
+
+	ch := make(chan Frame, 1)
+	id, err := s.PutIntoNextId(ch)
+	if err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.RemovePorts(id)
+	}()
+
+	start := time.Now()
+	if err := s.GoAway(GoAwayNormal); err != nil {
+		t.Fatalf("goaway: %v", err)
+	}
+	if time.Since(start) >= GOAWAY_DRAIN_TIMEOUT {
+		t.Fatalf("GoAway should have returned once the stream drained, not waited out the full timeout")
+	}
+}
+
+// TestSessionGoAwayIsIdempotent makes sure calling GoAway twice doesn't
+// resend MSG_GOAWAY or block the second time.
+func TestSessionGoAwayIsIdempotent(t *testing.T) {
+	s, _ := newTestSession(t)
+	defer s.Close()
+
+	if err := s.GoAway(GoAwayNormal); err != nil {
+		t.Fatalf("first goaway: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.GoAway(GoAwayNormal) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("second goaway: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("second GoAway call should return immediately, not resend or re-drain")
+	}
+}
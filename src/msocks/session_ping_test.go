@@ -0,0 +1,65 @@
+package msocks
+
+import (
+	"testing"
+	"time"
+)
+
+// TestSessionPingRTT drives Ping()'s success path: once the matching
+// MSG_PING_ACK arrives, Ping must return a positive rtt instead of
+// blocking or erroring.
+func TestSessionPingRTT(t *testing.T) {
+	s, _ := newTestSession(t)
+	defer s.Close()
+	s.cfg.ConnectionWriteTimeout = time.Second
+
+	type result struct {
+		rtt time.Duration
+		err error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		rtt, err := s.Ping()
+		resultCh <- result{rtt, err}
+	}()
+
+	// Ping() hands out sequential ids starting at 0, so the first Ping
+	// issued against a fresh Session is always id 0.
+	time.Sleep(20 * time.Millisecond)
+	s.on_ping_ack(&FramePing{PingId: 0, IsReply: true})
+
+	select {
+	case res := <-resultCh:
+		if res.err != nil {
+			t.Fatalf("ping: %v", res.err)
+		}
+		if res.rtt <= 0 {
+			t.Fatalf("expected a positive rtt, got %v", res.rtt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ping never returned")
+	}
+}
+
+// TestSessionPingTimeout drives Ping()'s failure path: if no ack
+// arrives within ConnectionWriteTimeout, Ping must give up with
+// errPingTimeout rather than blocking forever.
+func TestSessionPingTimeout(t *testing.T) {
+	s, _ := newTestSession(t)
+	defer s.Close()
+	s.cfg.ConnectionWriteTimeout = 30 * time.Millisecond
+
+	if _, err := s.Ping(); err != errPingTimeout {
+		t.Fatalf("expected errPingTimeout, got %v", err)
+	}
+}
+
+// TestSessionOnPingAckIgnoresUnknownId makes sure a stray or duplicate
+// ack (e.g. arriving after the Ping() call already timed out and
+// cleaned up its entry) doesn't panic.
+func TestSessionOnPingAckIgnoresUnknownId(t *testing.T) {
+	s, _ := newTestSession(t)
+	defer s.Close()
+
+	s.on_ping_ack(&FramePing{PingId: 999, IsReply: true})
+}
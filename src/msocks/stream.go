@@ -0,0 +1,268 @@
+package msocks
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// WND_ACK_RATIO controls how soon the receiver acks consumed bytes
+// back to the peer: once at least WIN_SIZE/WND_ACK_RATIO bytes have
+// been read off a stream, a MSG_WND_INC is sent so the sender's window
+// grows again. A larger ratio acks more eagerly at the cost of extra
+// control traffic.
+const WND_ACK_RATIO = 2
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "msocks: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var errTimeout error = timeoutError{}
+
+// Stream is one multiplexed connection inside a Session, implementing
+// net.Conn so it can be handed to anything that expects one. Unlike
+// the old fixed CHANLEN channel, a Stream is flow-controlled:
+// sendWindow tracks how many more bytes the peer is willing to
+// buffer, and consumed tracks how much of our own advertised window
+// Read has drained so we know when to replenish it.
+type Stream struct {
+	streamid uint16
+	sess     *Session
+	ch       chan Frame
+
+	readLock     sync.Mutex
+	readCond     *sync.Cond
+	readBuf      []byte
+	readEOF      bool
+	consumed     int32
+	readDeadline time.Time
+	readTimer    *time.Timer
+
+	wndLock       sync.Mutex
+	wndCond       *sync.Cond
+	sendWindow    int32
+	writeDeadline time.Time
+	writeTimer    *time.Timer
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewStream creates a Stream bound to streamid on sess, with both
+// directions starting at the default WIN_SIZE window. ch is the frame
+// channel registered for this streamid in sess.ports.
+func NewStream(streamid uint16, sess *Session, ch chan Frame) (st *Stream) {
+	st = &Stream{
+		streamid:   streamid,
+		sess:       sess,
+		ch:         ch,
+		sendWindow: WIN_SIZE,
+		closed:     make(chan struct{}),
+	}
+	st.readCond = sync.NewCond(&st.readLock)
+	st.wndCond = sync.NewCond(&st.wndLock)
+	go st.loop()
+	return
+}
+
+// loop pulls frames off ch: DATA payload is appended for Read to
+// drain, WND_INC grows sendWindow, FIN half-closes the read side, and
+// a nil frame (session teardown) ends both directions.
+func (st *Stream) loop() {
+	for f := range st.ch {
+		if f == nil {
+			st.readLock.Lock()
+			st.readEOF = true
+			st.readCond.Broadcast()
+			st.readLock.Unlock()
+			st.closeOnce.Do(func() { close(st.closed) })
+			st.wndLock.Lock()
+			st.wndCond.Broadcast()
+			st.wndLock.Unlock()
+			return
+		}
+		switch ft := f.(type) {
+		case *FrameData:
+			st.readLock.Lock()
+			st.readBuf = append(st.readBuf, ft.Data...)
+			st.readCond.Broadcast()
+			st.readLock.Unlock()
+		case *FrameWndInc:
+			st.wndLock.Lock()
+			st.sendWindow += ft.Delta
+			st.wndLock.Unlock()
+			st.wndCond.Broadcast()
+		case *FrameFin:
+			// Half-close: the peer has no more data for us, but it
+			// may still be reading what we send, so only end our
+			// read side instead of tearing the whole stream down.
+			st.readLock.Lock()
+			st.readEOF = true
+			st.readCond.Broadcast()
+			st.readLock.Unlock()
+		default:
+			logger.Errf("stream(%d): unexpected frame %T in chan.", st.streamid, f)
+		}
+	}
+}
+
+// Write blocks until the peer has advertised enough sendWindow to
+// accept at least part of b, splitting b across as many DATA frames
+// as the window requires.
+func (st *Stream) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		st.wndLock.Lock()
+		for st.sendWindow <= 0 {
+			select {
+			case <-st.closed:
+				st.wndLock.Unlock()
+				return n, io.EOF
+			default:
+			}
+			if st.writeTimedOut() {
+				st.wndLock.Unlock()
+				return n, errTimeout
+			}
+			st.wndCond.Wait()
+		}
+		size := len(b)
+		if int32(size) > st.sendWindow {
+			size = int(st.sendWindow)
+		}
+		st.sendWindow -= int32(size)
+		st.wndLock.Unlock()
+
+		_, err = st.sess.enqueueFrame(NewFrameData(st.streamid, b[:size]), st.streamid, PriorityData)
+		if err != nil {
+			return
+		}
+		n += size
+		b = b[size:]
+	}
+	return
+}
+
+func (st *Stream) writeTimedOut() bool {
+	return !st.writeDeadline.IsZero() && time.Now().After(st.writeDeadline)
+}
+
+// Read drains received DATA payload and, once consumed crosses the
+// ack threshold, sends a MSG_WND_INC so the peer's sendWindow grows
+// back and bulk transfer doesn't stall behind a slow reader.
+func (st *Stream) Read(b []byte) (n int, err error) {
+	st.readLock.Lock()
+	for len(st.readBuf) == 0 && !st.readEOF {
+		if st.readTimedOut() {
+			st.readLock.Unlock()
+			return 0, errTimeout
+		}
+		st.readCond.Wait()
+	}
+	if len(st.readBuf) == 0 {
+		st.readLock.Unlock()
+		if st.readTimedOut() {
+			return 0, errTimeout
+		}
+		return 0, io.EOF
+	}
+	n = copy(b, st.readBuf)
+	st.readBuf = st.readBuf[n:]
+	st.consumed += int32(n)
+	delta := int32(0)
+	if st.consumed >= WIN_SIZE/WND_ACK_RATIO {
+		delta = st.consumed
+		st.consumed = 0
+	}
+	st.readLock.Unlock()
+
+	if delta > 0 {
+		b := NewFrameOneInt(MSG_WND_INC, st.streamid, int(delta))
+		if _, werr := st.sess.enqueueFrame(b, st.streamid, PriorityControl); werr != nil {
+			logger.Err(werr)
+		}
+	}
+	return
+}
+
+func (st *Stream) readTimedOut() bool {
+	return !st.readDeadline.IsZero() && time.Now().After(st.readDeadline)
+}
+
+// Close ends the stream: it tells the peer with a MSG_FIN, releases
+// the streamid, and unblocks any Read/Write waiting on it.
+func (st *Stream) Close() (err error) {
+	st.closeOnce.Do(func() {
+		close(st.closed)
+
+		if _, werr := st.sess.enqueueFrame(NewFrameNoParam(MSG_FIN, st.streamid), st.streamid, PriorityControl); werr != nil {
+			logger.Err(werr)
+		}
+		if rerr := st.sess.RemovePorts(st.streamid); rerr != nil {
+			logger.Err(rerr)
+		}
+		select {
+		case st.ch <- nil:
+		default:
+		}
+
+		st.readLock.Lock()
+		st.readEOF = true
+		st.readCond.Broadcast()
+		st.readLock.Unlock()
+
+		st.wndLock.Lock()
+		st.wndCond.Broadcast()
+		st.wndLock.Unlock()
+	})
+	return
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.sess.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.sess.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	if err := st.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return st.SetWriteDeadline(t)
+}
+
+// SetReadDeadline arms a timer that wakes a blocked Read once t
+// passes, since sync.Cond has no native timeout support.
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.readLock.Lock()
+	defer st.readLock.Unlock()
+	st.readDeadline = t
+	if st.readTimer != nil {
+		st.readTimer.Stop()
+		st.readTimer = nil
+	}
+	if !t.IsZero() {
+		st.readTimer = time.AfterFunc(time.Until(t), st.readCond.Broadcast)
+	}
+	return nil
+}
+
+// SetWriteDeadline arms a timer that wakes a blocked Write once t
+// passes, for the same reason as SetReadDeadline.
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.wndLock.Lock()
+	defer st.wndLock.Unlock()
+	st.writeDeadline = t
+	if st.writeTimer != nil {
+		st.writeTimer.Stop()
+		st.writeTimer = nil
+	}
+	if !t.IsZero() {
+		st.writeTimer = time.AfterFunc(time.Until(t), st.wndCond.Broadcast)
+	}
+	return nil
+}
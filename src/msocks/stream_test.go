@@ -0,0 +1,97 @@
+package msocks
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+// TestStreamWriteBlocksUntilWindowGrows exercises the sendWindow side of
+// the flow control math: Write must block once the window is exhausted
+// and only proceed once a MSG_WND_INC grows it back.
+func TestStreamWriteBlocksUntilWindowGrows(t *testing.T) {
+	s, _ := newTestSession(t)
+	defer s.Close()
+
+	ch := make(chan Frame, CHANLEN)
+	st := NewStream(1, s, ch)
+
+	st.wndLock.Lock()
+	st.sendWindow = 4
+	st.wndLock.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := st.Write([]byte("hello world"))
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("write should have blocked with an exhausted send window")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ch <- &FrameWndInc{Streamid: 1, Delta: 1 << 20}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write never unblocked after the window grew")
+	}
+}
+
+// TestStreamReadAcksAfterHalfWindow exercises the consumed side: once
+// enough bytes have been read to cross WIN_SIZE/WND_ACK_RATIO, consumed
+// must reset to 0, i.e. a MSG_WND_INC was queued for the delta.
+func TestStreamReadAcksAfterHalfWindow(t *testing.T) {
+	s, _ := newTestSession(t)
+	defer s.Close()
+
+	ch := make(chan Frame, CHANLEN)
+	st := NewStream(2, s, ch)
+
+	payload := make([]byte, WIN_SIZE/WND_ACK_RATIO)
+	ch <- &FrameData{Streamid: 2, Data: payload}
+
+	buf := make([]byte, len(payload))
+	if _, err := io.ReadFull(st, buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	st.readLock.Lock()
+	consumed := st.consumed
+	st.readLock.Unlock()
+	if consumed != 0 {
+		t.Fatalf("expected consumed to reset to 0 once the ack threshold fired, got %d", consumed)
+	}
+}
+
+// TestStreamReadBelowThresholdDoesNotAck makes sure small reads don't
+// trigger a premature ack: consumed should keep accumulating instead of
+// resetting until the threshold is actually crossed.
+func TestStreamReadBelowThresholdDoesNotAck(t *testing.T) {
+	s, _ := newTestSession(t)
+	defer s.Close()
+
+	ch := make(chan Frame, CHANLEN)
+	st := NewStream(3, s, ch)
+
+	payload := []byte("short")
+	ch <- &FrameData{Streamid: 3, Data: payload}
+
+	buf := make([]byte, len(payload))
+	if _, err := io.ReadFull(st, buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	st.readLock.Lock()
+	consumed := st.consumed
+	st.readLock.Unlock()
+	if consumed != int32(len(payload)) {
+		t.Fatalf("expected consumed to accumulate to %d, got %d", len(payload), consumed)
+	}
+}
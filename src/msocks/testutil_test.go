@@ -0,0 +1,18 @@
+package msocks
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// newTestSession wires a Session to one end of a net.Pipe and drains
+// whatever the other end writes in the background, so tests can drive
+// Session/Stream logic without a real socket or peer.
+func newTestSession(t *testing.T) (s *Session, remote net.Conn) {
+	t.Helper()
+	local, remote := net.Pipe()
+	go io.Copy(io.Discard, remote)
+	s = NewSession(local, &Config{EnableKeepAlive: false})
+	return s, remote
+}
@@ -0,0 +1,151 @@
+package msocks
+
+import (
+	"io"
+	"sync"
+)
+
+const (
+	// PriorityControl is for PING/OK/FAILED/GOAWAY/WND_INC: small,
+	// latency-sensitive frames that must never wait behind a
+	// saturated data stream.
+	PriorityControl = iota
+	// PriorityData is for per-stream DATA frames, fairness-scheduled
+	// round-robin across streams so one bulk transfer can't starve
+	// the others.
+	PriorityData
+)
+
+type writeRequest struct {
+	streamid uint16
+	b        []byte
+	done     chan error
+}
+
+// writer replaces writing frames straight onto s.flock-guarded conn
+// with a priority scheduler: control frames go out on a shared
+// high-priority queue, DATA frames are queued per-stream and
+// round-robined so a slow bulk stream can't head-of-line-block a PING
+// or GOAWAY. Every send still goes through Session.Write's single conn,
+// so a pool of writer goroutines would just queue up behind the same
+// lock without letting more than one write be in flight at a time;
+// one dedicated goroutine (run) is both enough and what makes the
+// control-before-data ordering below deterministic.
+type writer struct {
+	sess *Session
+
+	control chan *writeRequest
+	dataIn  chan *writeRequest
+	dataOut chan *writeRequest
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newWriter(sess *Session) *writer {
+	w := &writer{
+		sess:    sess,
+		control: make(chan *writeRequest, CHANLEN),
+		dataIn:  make(chan *writeRequest, CHANLEN),
+		dataOut: make(chan *writeRequest),
+		closed:  make(chan struct{}),
+	}
+	go w.dispatch()
+	go w.run()
+	return w
+}
+
+// enqueue queues b for sending and returns a channel that receives the
+// write's result once a worker gets to it.
+func (w *writer) enqueue(streamid uint16, b []byte, priority int) chan error {
+	req := &writeRequest{streamid: streamid, b: b, done: make(chan error, 1)}
+
+	var in chan *writeRequest
+	if priority == PriorityControl {
+		in = w.control
+	} else {
+		in = w.dataIn
+	}
+
+	select {
+	case in <- req:
+	case <-w.closed:
+		req.done <- io.EOF
+	}
+	return req.done
+}
+
+// dispatch buffers incoming DATA frames per stream and round-robins
+// them onto dataOut, so a single fast sender doesn't monopolize the
+// writer goroutine.
+func (w *writer) dispatch() {
+	queues := make(map[uint16][]*writeRequest)
+	var order []uint16
+
+	for {
+		if len(order) == 0 {
+			select {
+			case req := <-w.dataIn:
+				queues[req.streamid] = append(queues[req.streamid], req)
+				order = append(order, req.streamid)
+			case <-w.closed:
+				return
+			}
+			continue
+		}
+
+		id := order[0]
+		req := queues[id][0]
+
+		select {
+		case w.dataOut <- req:
+			queues[id] = queues[id][1:]
+			order = order[1:]
+			if len(queues[id]) > 0 {
+				order = append(order, id)
+			} else {
+				delete(queues, id)
+			}
+		case req := <-w.dataIn:
+			if _, ok := queues[req.streamid]; !ok {
+				order = append(order, req.streamid)
+			}
+			queues[req.streamid] = append(queues[req.streamid], req)
+		case <-w.closed:
+			return
+		}
+	}
+}
+
+// run always tries control before data, so keepalives and GOAWAY keep
+// flowing even while a stream is saturating the socket.
+func (w *writer) run() {
+	for {
+		select {
+		case req := <-w.control:
+			w.send(req)
+			continue
+		default:
+		}
+
+		select {
+		case req := <-w.control:
+			w.send(req)
+		case req := <-w.dataOut:
+			w.send(req)
+		case <-w.closed:
+			return
+		}
+	}
+}
+
+func (w *writer) send(req *writeRequest) {
+	_, err := w.sess.Write(req.b)
+	req.done <- err
+}
+
+func (w *writer) Close() {
+	w.closeOnce.Do(func() {
+		close(w.closed)
+	})
+}